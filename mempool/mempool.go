@@ -7,73 +7,166 @@ package mempool
 import (
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
-var (
-	mallocCnt     int64
-	mallocCntSize int64
-	freeCnt       int64
-	freeCntSize   int64
+var DefaultMemPool = NewChosMemPool(64)
+
+// defaultClassCount is used by New when no explicit baselines are given.
+const defaultClassCount = 5
+
+// tuneInterval is how often the background goroutine re-balances classes.
+const tuneInterval = 5 * time.Second
+
+// Per-interval miss ratio (misses / gets) above which a class's baseline
+// is grown, and miss ratio below which a class's baseline is shrunk and
+// part of its pooled buffers dropped. A class whose miss ratio lies
+// between the two, or that had no Gets in the interval, is left as it
+// is: idle classes are neither shrunk nor drained.
+const (
+	growMissRatio = 0.5
+	drainHitRatio = 0.1
 )
 
-var DefaultMemPool = NewChosMemPool(64)
+// minBaseline is the smallest a class's baseline is ever shrunk to.
+const minBaseline = 64
+
+// class is one size tier of a MemPool: a sync.Pool of buffers around a
+// baseline size, plus the counters used to grow, shrink and drain it.
+type class struct {
+	baseline int64 // atomic; the tuning goroutine may grow/shrink this
+	pool     sync.Pool
 
-var pos = []byte{0, 1, 28, 2, 29, 14, 24, 3,
-	30, 22, 20, 15, 25, 17, 4, 8, 31, 27, 13, 23, 21, 19,
-	16, 7, 26, 12, 18, 6, 11, 5, 10, 9}
+	get         int64
+	put         int64
+	miss        int64
+	half        int64
+	less        int64
+	equal       int64
+	greater     int64
+	pooledBytes int64 // atomic; bytes this class believes sit idle in pool
 
-// MemPool definition
+	// lastGet/lastMiss are only read and written by the tuning
+	// goroutine, to turn the lifetime get/miss counters into a
+	// per-interval delta.
+	lastGet, lastMiss int64
+}
+
+func newClass(baseline int) *class {
+	// pool.New is left nil on purpose: sync.Pool can't tell us when it
+	// ran New, and we need that to count misses per class.
+	return &class{baseline: int64(baseline)}
+}
+
+// MemPool is a tiered, size-classed buffer pool inspired by goleveldb's
+// BufferPool. Instead of a single power-of-two ladder it keeps a handful
+// of sync.Pools centered on baseline sizes, each with its own hit/miss
+// accounting, and a background goroutine that grows, shrinks and drains
+// classes to track the sizes actually being requested.
 type MemPool struct {
-	maxSize int
-	buffers []sync.Pool
+	maxSize   int
+	classes   []*class
+	baselines []int // staged by Option funcs, consumed once by init
+
+	zeroOnFree    bool
+	poisonOnAlloc bool
+	poison        byte
+	maxIdleBytes  int64
+
+	closeOnce sync.Once
+	closeC    chan struct{}
 }
 
-// debrujin algorithm
-func (pool *MemPool) maxBits(size int) byte {
-	v := uint32(size)
-	v |= v >> 1
-	v |= v >> 2
-	v |= v >> 4
-	v |= v >> 8
-	v |= v >> 16
-	v = (v >> 1) + 1
-	ret := pos[(v*0x077CB531)>>27]
-	if size > 1<<ret {
-		ret++
+// Option configures a MemPool at construction time.
+type Option func(*MemPool)
+
+// WithBaselines sets the class boundaries directly (ascending; class i
+// then covers (baselines[i-1], baselines[i]]) instead of New's default
+// ladder.
+func WithBaselines(baselines ...int) Option {
+	return func(pool *MemPool) {
+		pool.baselines = baselines
 	}
-	return ret
 }
 
-// init buffers
-func (pool *MemPool) init(maxSize int) {
-	pool.maxSize = maxSize
+// WithZeroOnFree memsets every buffer to 0 inside Free before it's
+// returned to the pool. nbio reuses buffers across connections, so
+// without this TLS keying material or HTTP auth headers from a previous
+// connection can sit in memory handed to the next one.
+func WithZeroOnFree() Option {
+	return func(pool *MemPool) {
+		pool.zeroOnFree = true
+	}
+}
+
+// WithPoisonOnAlloc fills every buffer Malloc returns with b, so a read
+// of memory the caller hasn't written yet returns a deterministic
+// sentinel instead of silently reusing whatever the previous owner left
+// behind.
+func WithPoisonOnAlloc(b byte) Option {
+	return func(pool *MemPool) {
+		pool.poisonOnAlloc = true
+		pool.poison = b
+	}
+}
+
+// WithMaxIdleBytes limits the total capacity Free will let accumulate in
+// the pool; once the classes' tracked resident bytes reach n, Free stops
+// pooling and lets the buffer be collected instead, so a long-lived idle
+// server doesn't keep its peak-load memory forever. The check is made
+// before a buffer is pooled, so the pool can hold up to one buffer's
+// capacity more than n.
+func WithMaxIdleBytes(n int64) Option {
+	return func(pool *MemPool) {
+		pool.maxIdleBytes = n
+	}
+}
+
+// defaultBaselines builds a handful of classes doubling from 64 bytes up
+// to maxSize.
+func defaultBaselines(maxSize int) []int {
+	baselines := make([]int, 0, defaultClassCount)
+	for baseline := 64; len(baselines) < defaultClassCount-1 && baseline < maxSize; baseline *= 2 {
+		baselines = append(baselines, baseline)
+	}
+	return append(baselines, maxSize)
+}
 
-	pool.buffers = make([]sync.Pool, pool.maxBits(maxSize)+1)
-	for k := range pool.buffers {
-		i := k
-		pool.buffers[k].New = func() interface{} {
-			return make([]byte, 1<<uint32(i))
+// classFor returns the class covering size n: the first class whose
+// baseline is >= n, i.e. the one where the previous class's baseline < n
+// <= baseline (baseline/2 < n <= baseline on New's doubling default
+// ladder). Sizes larger than every baseline fall into the last (largest)
+// class.
+func (pool *MemPool) classFor(n int) int {
+	for i, c := range pool.classes {
+		if int64(n) <= atomic.LoadInt64(&c.baseline) {
+			return i
 		}
 	}
+	return len(pool.classes) - 1
 }
 
-func printStack(s, c int) {
-	// i := 2
-	// str := ""
-	// for ; i < 5; i++ {
-	// 	pc, file, line, ok := runtime.Caller(i)
-	// 	if !ok {
-	// 		break
-	// 	}
-	// 	str += fmt.Sprintf("\tstack: %d %v [file: %s] [func: %s] [line: %d]\n", i-1, ok, file, runtime.FuncForPC(pc).Name(), line)
-	// }
-	// println("size:", s, "cap:", c)
-	// println(str)
+// init sets up classes and starts the tuning goroutine.
+func (pool *MemPool) init(maxSize int, baselines []int) {
+	pool.maxSize = maxSize
+	pool.closeC = make(chan struct{})
+	if len(baselines) == 0 {
+		baselines = defaultBaselines(maxSize)
+	}
+	pool.classes = make([]*class, len(baselines))
+	for i, b := range baselines {
+		pool.classes[i] = newClass(b)
+	}
+	go pool.tuneLoop()
+	pool.armGCSentinel()
 }
 
 // Malloc borrows []byte from pool
@@ -81,19 +174,49 @@ func (pool *MemPool) Malloc(size int) []byte {
 	if size <= 0 || size > pool.maxSize {
 		return nil
 	}
-	allocSize := size
-	if size < 64 {
-		allocSize = 64
+	buf := pool.malloc(size)
+	if pool.poisonOnAlloc {
+		for i := range buf {
+			buf[i] = pool.poison
+		}
 	}
-	buf := pool.buffers[pool.maxBits(allocSize)].Get().([]byte)[:size]
-	atomic.AddInt64(&mallocCnt, 1)
-	atomic.AddInt64(&mallocCntSize, int64(cap(buf)))
-	// fmt.Println("+++ Malloc:", cap(buf))
-	printStack(size, cap(buf))
-
 	return buf
 }
 
+func (pool *MemPool) malloc(size int) []byte {
+	c := pool.classes[pool.classFor(size)]
+	atomic.AddInt64(&c.get, 1)
+
+	v := c.pool.Get()
+	if v == nil {
+		atomic.AddInt64(&c.miss, 1)
+		return make([]byte, size)
+	}
+
+	buf := v.([]byte)
+	atomic.AddInt64(&c.pooledBytes, -int64(cap(buf)))
+	switch {
+	case cap(buf) < size:
+		// the class's baseline lagged behind a burst of larger
+		// requests; don't hand back something too small
+		atomic.AddInt64(&c.less, 1)
+		return make([]byte, size)
+	case cap(buf) >= 2*size:
+		// oversized hit: don't let a small request monopolize a big
+		// buffer, put it back and allocate exactly what was asked for
+		atomic.AddInt64(&c.half, 1)
+		atomic.AddInt64(&c.put, 1)
+		atomic.AddInt64(&c.pooledBytes, int64(cap(buf)))
+		c.pool.Put(buf)
+		return make([]byte, size)
+	case cap(buf) == size:
+		atomic.AddInt64(&c.equal, 1)
+	default:
+		atomic.AddInt64(&c.greater, 1)
+	}
+	return buf[:size]
+}
+
 // Realloc returns the buf passed in if it's size <= cap
 // else payback the buf to pool, then borrows and returns a new []byte from pool
 func (pool *MemPool) Realloc(buf []byte, size int) []byte {
@@ -108,32 +231,239 @@ func (pool *MemPool) Realloc(buf []byte, size int) []byte {
 
 // Free payback []byte to pool
 func (pool *MemPool) Free(buf []byte) error {
-	bits := pool.maxBits(cap(buf))
-	if cap(buf) == 0 || cap(buf) > pool.maxSize || cap(buf) != 1<<bits {
+	if cap(buf) == 0 || cap(buf) > pool.maxSize {
 		return errors.New("MemPool Put() incorrect buffer size")
 	}
-	printStack(len(buf), cap(buf))
-	atomic.AddInt64(&freeCnt, 1)
-	atomic.AddInt64(&freeCntSize, int64(cap(buf)))
-	pool.buffers[bits].Put(buf)
-	// fmt.Println("--- Free:", cap(buf))
-	// debug.PrintStack()
+	buf = buf[:cap(buf)]
+	if pool.zeroOnFree {
+		for i := range buf {
+			buf[i] = 0
+		}
+	}
+	if pool.maxIdleBytes > 0 && pool.idleBytes() >= pool.maxIdleBytes {
+		return nil
+	}
+	c := pool.classes[pool.classFor(cap(buf))]
+	atomic.AddInt64(&c.put, 1)
+	atomic.AddInt64(&c.pooledBytes, int64(cap(buf)))
+	c.pool.Put(buf)
 	return nil
 }
 
+// idleBytes sums each class's pooledBytes, a dedicated counter kept in
+// step with every Put/Get so it reflects bytes actually sitting in the
+// pool. put - get is not usable for this: every well-behaved Free
+// corresponds to a prior Malloc, so cumulatively put <= get and the
+// difference never goes positive.
+//
+// pooledBytes only tracks Puts and Gets we made ourselves: sync.Pool
+// also silently drops entries across GC cycles without telling us, so
+// left alone the counter only grows and would eventually throttle Free
+// to native allocation well below the configured budget. armGCSentinel
+// resets it back down on every GC to keep it from diverging upward.
+func (pool *MemPool) idleBytes() int64 {
+	var total int64
+	for _, c := range pool.classes {
+		total += atomic.LoadInt64(&c.pooledBytes)
+	}
+	return total
+}
+
+// armGCSentinel arranges for reconcilePooledBytes to run once per GC
+// cycle, using the usual SetFinalizer-on-a-throwaway-object trick: s is
+// never referenced again, so it becomes eligible for collection at the
+// next GC, and its finalizer re-arms a fresh sentinel for the one after
+// that.
+func (pool *MemPool) armGCSentinel() {
+	s := new(gcSentinel)
+	runtime.SetFinalizer(s, func(*gcSentinel) {
+		pool.reconcilePooledBytes()
+		select {
+		case <-pool.closeC:
+		default:
+			pool.armGCSentinel()
+		}
+	})
+}
+
+type gcSentinel struct{}
+
+// reconcilePooledBytes resets every class's pooledBytes to 0. sync.Pool
+// gives us no way to ask what it actually kept across a GC, and 0 is
+// the one value we can state is never an overcount, so between GCs
+// WithMaxIdleBytes only throttles Free based on what's been pooled
+// since the last cycle rather than a stale lifetime total.
+func (pool *MemPool) reconcilePooledBytes() {
+	for _, c := range pool.classes {
+		atomic.StoreInt64(&c.pooledBytes, 0)
+	}
+}
+
+// Close stops the background tuning goroutine. Safe to call more than
+// once; it does not drain buffers already sitting in the pool.
+func (pool *MemPool) Close() error {
+	pool.closeOnce.Do(func() {
+		close(pool.closeC)
+	})
+	return nil
+}
+
+// tuneLoop periodically grows classes that are missing a lot, and shrinks
+// and partly drains classes that almost always hit. A class with no Gets
+// in an interval is skipped, so its pooled buffers are not drained by
+// tuneLoop.
+func (pool *MemPool) tuneLoop() {
+	ticker := time.NewTicker(tuneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pool.tune()
+		case <-pool.closeC:
+			return
+		}
+	}
+}
+
+func (pool *MemPool) tune() {
+	for i, c := range pool.classes {
+		get := atomic.LoadInt64(&c.get)
+		miss := atomic.LoadInt64(&c.miss)
+		// get/miss are lifetime-cumulative; diff against the last tick
+		// so the ratio below reflects this interval, not the whole
+		// pool's history (which flatlines once enough hits pile up).
+		deltaGet := get - c.lastGet
+		deltaMiss := miss - c.lastMiss
+		c.lastGet, c.lastMiss = get, miss
+		if deltaGet == 0 {
+			continue
+		}
+
+		missRatio := float64(deltaMiss) / float64(deltaGet)
+		baseline := atomic.LoadInt64(&c.baseline)
+		switch {
+		case missRatio > growMissRatio:
+			grown := baseline * 2
+			if grown > int64(pool.maxSize) {
+				grown = int64(pool.maxSize)
+			}
+			// classFor relies on classes staying ascending; never grow
+			// past the next class's baseline, or this class would
+			// swallow sizes that belong to it.
+			if i+1 < len(pool.classes) {
+				if next := atomic.LoadInt64(&pool.classes[i+1].baseline); grown > next {
+					grown = next
+				}
+			}
+			if grown > baseline {
+				atomic.StoreInt64(&c.baseline, grown)
+			}
+		case missRatio < drainHitRatio:
+			// mostly hits this interval: shrink toward the sizes
+			// actually being requested, bounded below by minBaseline
+			// and by the previous class's baseline so classes stay
+			// ascending for classFor.
+			shrunk := baseline / 2
+			if shrunk < minBaseline {
+				shrunk = minBaseline
+			}
+			if i > 0 {
+				if prev := atomic.LoadInt64(&pool.classes[i-1].baseline); shrunk < prev {
+					shrunk = prev
+				}
+			}
+			if shrunk < baseline {
+				atomic.StoreInt64(&c.baseline, shrunk)
+			}
+			pool.drainClass(c)
+		}
+	}
+}
+
+// drainClassFraction is the share of a class's estimated resident
+// buffers dropped per draining tuneInterval. A flat one-buffer-per-tick
+// drain would take a class holding thousands of idle buffers hours to
+// shed, so scale with how much is actually sitting there.
+const drainClassFraction = 0.5
+
+// drainClass drops a bounded share of c's idle buffers back to the
+// runtime instead of keeping every one of them pinned forever.
+func (pool *MemPool) drainClass(c *class) {
+	baseline := atomic.LoadInt64(&c.baseline)
+	if baseline <= 0 {
+		return
+	}
+	resident := atomic.LoadInt64(&c.pooledBytes) / baseline
+	toDrop := int64(float64(resident) * drainClassFraction)
+	if toDrop < 1 {
+		toDrop = 1
+	}
+	for n := int64(0); n < toDrop; n++ {
+		v := c.pool.Get()
+		if v == nil {
+			return
+		}
+		atomic.AddInt64(&c.pooledBytes, -int64(cap(v.([]byte))))
+	}
+}
+
+// Allocator is implemented by every buffer source in this package
+// (MemPool, ChosMemPool, NativeAllocator). The intent is for nbio's
+// Engine and Conn types to take an Allocator instead of calling the
+// package-level Malloc/Realloc/Free directly, so callers can pick
+// NativeAllocator for debugging under the race detector, MemPool for
+// steady-state throughput, or plug in a custom implementation (e.g. an
+// arena or cgo jemalloc wrapper).
+//
+// TODO(nbio integration): this is only the mempool-side half of that
+// request. Nothing in the engine/conn read loop, write buffers, or
+// websocket/HTTP parsers has been switched over to take an Allocator
+// yet — there is no per-Engine or per-Conn allocator field anywhere in
+// this tree. Do not consider the request done until that threading
+// lands; it can't happen from this package alone.
+type Allocator interface {
+	Malloc(size int) []byte
+	Realloc(buf []byte, size int) []byte
+	Free(buf []byte) error
+}
+
+var (
+	_ Allocator = (*MemPool)(nil)
+	_ Allocator = (*ChosMemPool)(nil)
+	_ Allocator = (*NativeAllocator)(nil)
+)
+
+var defaultAllocator atomic.Value // holds an Allocator
+
+func init() {
+	defaultAllocator.Store(Allocator(DefaultMemPool))
+}
+
+// SetDefault swaps the process-wide default allocator used by the
+// package-level Malloc/Realloc/Free. Safe to call concurrently with
+// them.
+func SetDefault(a Allocator) {
+	defaultAllocator.Store(a)
+}
+
+// Default returns the current process-wide default allocator.
+func Default() Allocator {
+	return defaultAllocator.Load().(Allocator)
+}
+
 // Malloc exports default package method
 func Malloc(size int) []byte {
-	return DefaultMemPool.Malloc(size)
+	return Default().Malloc(size)
 }
 
 // Realloc exports default package method
 func Realloc(buf []byte, size int) []byte {
-	return DefaultMemPool.Realloc(buf, size)
+	return Default().Realloc(buf, size)
 }
 
 // Free exports default package method
 func Free(buf []byte) error {
-	return DefaultMemPool.Free(buf)
+	return Default().Free(buf)
 }
 
 // NativeAllocator definition
@@ -159,32 +489,117 @@ func (a *NativeAllocator) Free(buf []byte) error {
 	return nil
 }
 
-// New factory
-func New(maxSize int) *MemPool {
+// New factory. Without WithBaselines, New picks a default ladder of
+// classes spanning 64B up to maxSize.
+func New(maxSize int, opts ...Option) *MemPool {
 	pool := &MemPool{}
-	pool.init(maxSize)
+	for _, opt := range opts {
+		opt(pool)
+	}
+	pool.init(maxSize, pool.baselines)
 	return pool
 }
 
-func State() (int64, int64, int64, int64, string) {
-	n1, n2, n3, n4 := atomic.LoadInt64(&mallocCnt), atomic.LoadInt64(&mallocCntSize), atomic.LoadInt64(&freeCnt), atomic.LoadInt64(&freeCntSize)
-	s := fmt.Sprintf("malloc num : %v\nmalloc size: %v\nfree num   : %v\nfree size  : %v\nleft times : %v\nleft size  : %v\n", n1, n2, n3, n4, n1-n3, n2-n4)
-	return n1, n2, n3, n4, s
+// ClassState is a point-in-time snapshot of one size class's counters.
+type ClassState struct {
+	Baseline int64
+	Get      int64
+	Put      int64
+	Miss     int64
+	Half     int64
+	Less     int64
+	Equal    int64
+	Greater  int64
+}
+
+// PoolState is a snapshot of every class in a MemPool, returned by
+// (*MemPool).State so callers can tune hot paths in nbio.
+type PoolState struct {
+	Classes []ClassState
+}
+
+// String formats the state as one line of counters per class, for quick
+// printing while debugging.
+func (s PoolState) String() string {
+	out := ""
+	for i, c := range s.Classes {
+		out += fmt.Sprintf("class %d: baseline=%v get=%v put=%v miss=%v half=%v less=%v equal=%v greater=%v\n",
+			i, c.Baseline, c.Get, c.Put, c.Miss, c.Half, c.Less, c.Equal, c.Greater)
+	}
+	return out
+}
+
+// State returns a snapshot of the per-class hit/miss/half counters.
+// Counters are cumulative since the pool was created.
+func (pool *MemPool) State() PoolState {
+	st := PoolState{Classes: make([]ClassState, len(pool.classes))}
+	for i, c := range pool.classes {
+		st.Classes[i] = ClassState{
+			Baseline: atomic.LoadInt64(&c.baseline),
+			Get:      atomic.LoadInt64(&c.get),
+			Put:      atomic.LoadInt64(&c.put),
+			Miss:     atomic.LoadInt64(&c.miss),
+			Half:     atomic.LoadInt64(&c.half),
+			Less:     atomic.LoadInt64(&c.less),
+			Equal:    atomic.LoadInt64(&c.equal),
+			Greater:  atomic.LoadInt64(&c.greater),
+		}
+	}
+	return st
+}
+
+// LeakSeverity controls how the leak detector reports a buffer that was
+// Malloc'd and never passed back to Free.
+type LeakSeverity int
+
+const (
+	// LeakSeverityWarn logs the allocation stack via log.Printf.
+	LeakSeverityWarn LeakSeverity = iota
+	// LeakSeverityFatal logs the allocation stack then os.Exit(1)s, the
+	// same way a double Free already does.
+	LeakSeverityFatal
+)
+
+// ChosOption configures a ChosMemPool at construction time.
+type ChosOption func(*ChosMemPool)
+
+// WithLeakDetector attaches a runtime.SetFinalizer to every buffer
+// Malloc returns. If a buffer is garbage collected without ever being
+// passed to Free, its original allocation stack is reported at the
+// given severity. Free clears the finalizer, so ordinary reuse through
+// the pool never triggers a false positive. This costs a stack capture
+// per Malloc, so only enable it while hunting a leak.
+func WithLeakDetector(severity LeakSeverity) ChosOption {
+	return func(c *ChosMemPool) {
+		c.leakDetector = true
+		c.leakSeverity = severity
+	}
 }
 
 // ChosMemPool
 type ChosMemPool struct {
 	minSize int
 	pool    sync.Pool
+
+	leakDetector bool
+	leakSeverity LeakSeverity
+	leakMtx      sync.Mutex
+	leakAlloc    map[uintptr][]byte // ptr -> allocation stack, cleared by Free
 }
 
-func NewChosMemPool(minSize int) *ChosMemPool {
+func NewChosMemPool(minSize int, opts ...ChosOption) *ChosMemPool {
 	if minSize <= 0 {
 		minSize = 64
 	}
 	c := &ChosMemPool{
 		minSize: minSize,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.leakDetector {
+		c.leakAlloc = make(map[uintptr][]byte)
+	}
 	c.pool.New = func() interface{} {
 		return make([]byte, minSize)
 	}
@@ -197,7 +612,47 @@ func (c *ChosMemPool) Malloc(size int) []byte {
 		c.pool.Put(b)
 		b = make([]byte, size)
 	}
-	return b[:size]
+	b = b[:size]
+	if c.leakDetector {
+		c.trackAlloc(b)
+	}
+	return b
+}
+
+// trackAlloc captures the current allocation stack and arms a finalizer
+// that fires if buf is garbage collected before Free clears it.
+func (c *ChosMemPool) trackAlloc(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	stack := make([]byte, 1024*32)
+	n := runtime.Stack(stack, false)
+	stack = stack[:n]
+
+	ptr := uintptr(unsafe.Pointer(&buf[0]))
+	c.leakMtx.Lock()
+	c.leakAlloc[ptr] = stack
+	c.leakMtx.Unlock()
+
+	runtime.SetFinalizer(&buf[0], func(*byte) {
+		c.leakMtx.Lock()
+		stack, leaked := c.leakAlloc[ptr]
+		delete(c.leakAlloc, ptr)
+		c.leakMtx.Unlock()
+		if leaked {
+			c.reportLeak(stack)
+		}
+	})
+}
+
+func (c *ChosMemPool) reportLeak(stack []byte) {
+	switch c.leakSeverity {
+	case LeakSeverityFatal:
+		fmt.Printf("mempool: buffer leaked, allocated at:\n%s", stack)
+		os.Exit(1)
+	default:
+		log.Printf("mempool: buffer leaked, allocated at:\n%s", stack)
+	}
 }
 
 // Realloc .
@@ -207,7 +662,7 @@ func (c *ChosMemPool) Realloc(buf []byte, size int) []byte {
 	}
 	newBuf := c.Malloc(size)
 	copy(newBuf, buf)
-	c.pool.Put(buf)
+	_ = c.Free(buf)
 	return newBuf[:size]
 }
 
@@ -218,20 +673,140 @@ var (
 
 // Free .
 func (c *ChosMemPool) Free(buf []byte) error {
-	sbuf := make([]byte, 1024*32)
-	n := runtime.Stack(sbuf, false)
-	sbuf = sbuf[:n]
-	ptr := uintptr(unsafe.Pointer(&buf[0]))
+	// The double-free stack capture below never forgets a pointer and
+	// os.Exit(1)s on any second Free of a recycled backing array, which
+	// is fine while hunting a bug with the leak detector on but far too
+	// hostile to be on by default now that Realloc routes through Free
+	// for every pool (including DefaultMemPool): gate it the same way.
+	if c.leakDetector && len(buf) > 0 {
+		sbuf := make([]byte, 1024*32)
+		n := runtime.Stack(sbuf, false)
+		sbuf = sbuf[:n]
+		ptr := uintptr(unsafe.Pointer(&buf[0]))
 
-	mtx.Lock()
-	defer mtx.Unlock()
-	if v, ok := stacks[ptr]; ok {
-		fmt.Printf("pre put: %v\n%v", len(v), string(v))
-		fmt.Printf("curr put: %v\n%v", len(sbuf), string(sbuf))
-		os.Exit(1)
-	} else {
+		mtx.Lock()
+		if v, ok := stacks[ptr]; ok {
+			fmt.Printf("pre put: %v\n%v", len(v), string(v))
+			fmt.Printf("curr put: %v\n%v", len(sbuf), string(sbuf))
+			mtx.Unlock()
+			os.Exit(1)
+		}
 		stacks[ptr] = sbuf
+		mtx.Unlock()
+
+		c.leakMtx.Lock()
+		delete(c.leakAlloc, ptr)
+		c.leakMtx.Unlock()
+		runtime.SetFinalizer(&buf[0], nil)
 	}
+
 	c.pool.Put(buf)
 	return nil
 }
+
+// bufferNode is one segment in a Buffers chain.
+type bufferNode struct {
+	buf  []byte
+	next *bufferNode
+}
+
+// Buffers is a linked list of pooled []byte segments. A parser that
+// already owns a pooled segment (e.g. one it just read a frame into)
+// should use AppendOwned to add it without copying; Append exists for
+// the common case of adding data the caller doesn't own, and still
+// costs a copy into a freshly pooled segment. Either way the engine can
+// hand the whole chain to WriteTo for a single writev.
+type Buffers struct {
+	allocator    Allocator
+	head, tail   *bufferNode
+	len          int
+	segmentCount int
+}
+
+// NewBuffers creates an empty segment chain that borrows and returns
+// segments through a. If a is nil, the package default allocator is
+// used.
+func NewBuffers(a Allocator) *Buffers {
+	if a == nil {
+		a = Default()
+	}
+	return &Buffers{allocator: a}
+}
+
+// Append copies p into a newly pooled segment and adds it to the chain.
+// This costs a copy; use AppendOwned if p is already a pooled buffer
+// the caller is done writing into.
+func (b *Buffers) Append(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	buf := b.allocator.Malloc(len(p))
+	copy(buf, p)
+	b.appendNode(&bufferNode{buf: buf})
+}
+
+// AppendOwned adds buf to the chain without copying it. The chain takes
+// ownership of buf and returns it through the allocator on Release, so
+// buf must have come from (or be safe to hand to) the same allocator
+// and must not be touched by the caller afterward. This is the
+// copy-free path the segment chain exists for: a parser that reads
+// directly into a pooled buffer can hand it straight in instead of
+// growing and copying via Realloc.
+func (b *Buffers) AppendOwned(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	b.appendNode(&bufferNode{buf: buf})
+}
+
+func (b *Buffers) appendNode(node *bufferNode) {
+	if b.tail == nil {
+		b.head, b.tail = node, node
+	} else {
+		b.tail.next = node
+		b.tail = node
+	}
+	b.len += len(node.buf)
+	b.segmentCount++
+}
+
+// Len returns the total number of bytes across all segments.
+func (b *Buffers) Len() int {
+	return b.len
+}
+
+// WriteTo writes every segment to w. When w is a net connection that
+// supports vectored writes (such as *net.TCPConn), net.Buffers hands the
+// chain to writev instead of issuing one Write per segment; for any
+// other io.Writer it falls back to writing each segment in turn.
+func (b *Buffers) WriteTo(w io.Writer) (int64, error) {
+	bufs := make(net.Buffers, 0, b.segmentCount)
+	for node := b.head; node != nil; node = node.next {
+		bufs = append(bufs, node.buf)
+	}
+	return bufs.WriteTo(w)
+}
+
+// Release returns every segment to the pool and empties the chain.
+func (b *Buffers) Release() {
+	for node := b.head; node != nil; {
+		next := node.next
+		b.allocator.Free(node.buf)
+		node.buf, node.next = nil, nil
+		node = next
+	}
+	b.head, b.tail = nil, nil
+	b.len, b.segmentCount = 0, 0
+}
+
+// Flatten copies every segment into a single pooled buffer of the
+// summed size. Prefer WriteTo to avoid the copy; Flatten exists
+// for the rare case a contiguous buffer is required.
+func (b *Buffers) Flatten() []byte {
+	buf := b.allocator.Malloc(b.len)
+	off := 0
+	for node := b.head; node != nil; node = node.next {
+		off += copy(buf[off:], node.buf)
+	}
+	return buf
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package mempool
+
+import (
+	"bytes"
+	"log"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer guards a bytes.Buffer with a mutex so it can be written by
+// log.Logger (from a finalizer goroutine) and read by the test goroutine
+// at the same time without racing.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Contains(sub string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Contains(b.buf.Bytes(), []byte(sub))
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestClassForRouting(t *testing.T) {
+	pool := New(1024, WithBaselines(64, 256, 1024))
+
+	cases := []struct {
+		size int
+		want int
+	}{
+		{1, 0},
+		{64, 0},
+		{65, 1},
+		{256, 1},
+		{257, 2},
+		{1024, 2},
+	}
+	for _, c := range cases {
+		if got := pool.classFor(c.size); got != c.want {
+			t.Errorf("classFor(%d) = %d, want %d", c.size, got, c.want)
+		}
+	}
+}
+
+func TestMallocFreeHalfRouting(t *testing.T) {
+	// With only two classes, (64,256] is wide enough that a 200-byte
+	// buffer and a later 100-byte request land in the same class.
+	pool := New(1024, WithBaselines(64, 256))
+
+	buf := pool.Malloc(200)
+	if len(buf) != 200 {
+		t.Fatalf("Malloc(200) len = %d, want 200", len(buf))
+	}
+	if err := pool.Free(buf); err != nil {
+		t.Fatalf("Free: %v", err)
+	}
+
+	// cap(buf) == 200 >= 2*100, so this should hit the oversized "half"
+	// path: the 200-cap buffer goes back to the pool and a
+	// right-sized 100-byte slice is allocated instead.
+	small := pool.Malloc(100)
+	if len(small) != 100 {
+		t.Fatalf("Malloc(100) len = %d, want 100", len(small))
+	}
+
+	st := pool.State()
+	if st.Classes[1].Half == 0 {
+		t.Errorf("expected class 1 to record a half hit, got state %+v", st.Classes[1])
+	}
+}
+
+func TestWithMaxIdleBytesStopsPooling(t *testing.T) {
+	pool := New(1024, WithBaselines(64, 256, 1024), WithMaxIdleBytes(1))
+
+	b1 := pool.Malloc(64)
+	b2 := pool.Malloc(64)
+	if err := pool.Free(b1); err != nil {
+		t.Fatalf("Free(b1): %v", err)
+	}
+	// b1's Free pushed idleBytes to 64, already over the 1-byte budget,
+	// so this Free must drop b2 instead of pooling it.
+	if err := pool.Free(b2); err != nil {
+		t.Fatalf("Free(b2): %v", err)
+	}
+
+	pool.Malloc(64) // hits the pooled b1
+	pool.Malloc(64) // b2 was never pooled, so this must miss
+
+	if got := pool.State().Classes[0].Miss; got != 3 {
+		t.Errorf("Miss = %d, want 3 (2 initial misses + 1 after WithMaxIdleBytes dropped b2)", got)
+	}
+}
+
+func TestBuffersWriteToAndRelease(t *testing.T) {
+	pool := New(1024)
+	b := NewBuffers(pool)
+
+	b.Append([]byte("hello "))
+	b.Append([]byte("world"))
+
+	if got, want := b.Len(), len("hello world"); got != want {
+		t.Fatalf("Len() = %d, want %d", got, want)
+	}
+
+	var out bytes.Buffer
+	n, err := b.WriteTo(&out)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if int(n) != b.Len() {
+		t.Fatalf("WriteTo returned %d, want %d", n, b.Len())
+	}
+	if out.String() != "hello world" {
+		t.Fatalf("WriteTo wrote %q, want %q", out.String(), "hello world")
+	}
+
+	b.Release()
+	if b.Len() != 0 {
+		t.Fatalf("Len() after Release = %d, want 0", b.Len())
+	}
+}
+
+func TestBuffersAppendOwnedDoesNotCopy(t *testing.T) {
+	pool := New(1024)
+	b := NewBuffers(pool)
+
+	owned := pool.Malloc(5)
+	copy(owned, "owned")
+	b.AppendOwned(owned)
+
+	if b.head == nil || &b.head.buf[0] != &owned[0] {
+		t.Fatalf("AppendOwned copied the buffer instead of taking ownership of it")
+	}
+	if got := string(b.head.buf); got != "owned" {
+		t.Fatalf("AppendOwned chain holds %q, want %q", got, "owned")
+	}
+}
+
+func TestChosMemPoolLeakDetectorWarns(t *testing.T) {
+	logged := &syncBuffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(nil)
+
+	c := NewChosMemPool(64, WithLeakDetector(LeakSeverityWarn))
+
+	func() {
+		_ = c.Malloc(64) // never Freed, so its finalizer should fire and warn
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runtime.GC()
+		if logged.Contains("leaked") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("leak detector did not report a leaked buffer; log contained: %q", logged.String())
+}